@@ -8,11 +8,12 @@ import (
 
 	"C"
 	"bytes"
-	"compress/gzip"
-	"encoding/json"
+	"context"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
 	"unsafe"
 
 	"github.com/fluent/fluent-bit-go/output"
@@ -33,20 +34,47 @@ type PluginConfig struct {
 	useApiKey                  bool
 	reportingSourceType        string
 	reportingSourceVersion     string
+	maxRetries                 int64
+	disableRetryLimit          bool
+	retryInitialBackoffMs      int64
+	retryMaxBackoffMs          int64
+	flushWorkers               int64
+	flushQueueDepth            int64
+	spoolPath                  string
+	spoolMaxSizeMB             int64
+	spoolMaxBackups            int64
+	spoolMaxAgeDays            int64
+	spoolCompress              bool
+	requestTimeoutMs           int64
+	shutdownGracePeriodMs      int64
+	payloadFormat              string
+	commonAttributes           []string
+	severityKey                string
 }
 
 type BufferManager struct {
 	config PluginConfig
 	buffer []map[string]interface{}
+	mu sync.Mutex
 	client *http.Client
 	lastFlushTime int64
+	retryQueue chan retryPayload
+	retrySignal *int32
+	flushQueue chan flushJob
+	flushQueueMu sync.Mutex
+	flushQueueClosed bool
+	retryQueueMu sync.Mutex
+	retryQueueClosed bool
+	wg sync.WaitGroup
+	spool *Spool
+	ctx context.Context
+	cancel context.CancelFunc
 }
 
-var bufferManager BufferManager
+var bufferManager *BufferManager
 
-func newBufferManager(config PluginConfig) BufferManager {
+func newBufferManager(config PluginConfig, pluginCtx context.Context, cancel context.CancelFunc) *BufferManager {
 	keepAliveTimeout := 600 * time.Second
-	timeout := 5 * time.Second
 	defaultTransport := &http.Transport{
 		Dial: (&net.Dialer{
 			KeepAlive: keepAliveTimeout,
@@ -56,19 +84,61 @@ func newBufferManager(config PluginConfig) BufferManager {
 	}
 	client := &http.Client{
 		Transport: defaultTransport,
-		Timeout: timeout,
 	}
 
-	return BufferManager{
+	bm := &BufferManager{
 		lastFlushTime: timeNowInMiliseconds(),
 		config: config,
 		client: client,
+		retryQueue: make(chan retryPayload, defaultRetryQueueDepth),
+		retrySignal: new(int32),
+		flushQueue: make(chan flushJob, config.flushQueueDepth),
+		ctx: pluginCtx,
+		cancel: cancel,
+	}
+	for i := int64(0); i < config.flushWorkers; i++ {
+		bm.wg.Add(1)
+		go bm.flushWorker()
+	}
+	bm.wg.Add(1)
+	go bm.retryWorker()
+
+	if config.spoolPath != "" {
+		spool, err := newSpool(config)
+		if err != nil {
+			log.Printf("[ERROR] failed opening spool at %s: %s", config.spoolPath, err)
+		} else {
+			bm.spool = spool
+			bm.requeueUnacked()
+		}
+	}
+	return bm
+}
+
+// requeueUnacked re-enqueues any spool entries left over from a previous
+// process that crashed or shut down before New Relic acknowledged them.
+func (bufferManager *BufferManager) requeueUnacked() {
+	pending := bufferManager.spool.loadUnacked()
+	for _, p := range pending {
+		entry := p.entry
+		bufferManager.dispatch(flushJob{
+			payload: p.payload,
+			attempt: 1,
+			ack:     func() { bufferManager.spool.ack(entry) },
+		})
+	}
+	if len(pending) > 0 {
+		log.Printf("[INFO] re-enqueued %d unacked spool entries", len(pending))
 	}
 }
 
 func (bufferManager *BufferManager) addRecord(record map[string]interface{}) chan *http.Response {
+	bufferManager.mu.Lock()
 	bufferManager.buffer = append(bufferManager.buffer, record)
-	if bufferManager.shouldSend() {
+	send := bufferManager.shouldSend()
+	bufferManager.mu.Unlock()
+
+	if send {
 		return bufferManager.sendRecords()
 	}
 
@@ -76,19 +146,25 @@ func (bufferManager *BufferManager) addRecord(record map[string]interface{}) cha
 }
 
 func (bufferManager *BufferManager) isEmpty() bool {
+	bufferManager.mu.Lock()
+	defer bufferManager.mu.Unlock()
 	return len(bufferManager.buffer) == 0
 }
 
+// shouldSend must be called with bufferManager.mu held.
 func (bufferManager *BufferManager) shouldSend() bool {
 	return (int64(len(bufferManager.buffer)) >= bufferManager.config.maxRecords) ||
 		(((timeNowInMiliseconds() - bufferManager.lastFlushTime)) > bufferManager.config.maxTimeBetweenFlushes)
 }
 
 func (bufferManager *BufferManager) sendRecords() (responseChan chan *http.Response) {
+	bufferManager.mu.Lock()
 	newBuffer := make([]map[string]interface{}, len(bufferManager.buffer))
 	copy(newBuffer, bufferManager.buffer)
 	bufferManager.buffer = nil
 	bufferManager.lastFlushTime = timeNowInMiliseconds()
+	bufferManager.mu.Unlock()
+
 	responseChan = make(chan *http.Response, 1)
 	bufferManager.prepare(newBuffer, responseChan)
 	return responseChan
@@ -96,64 +172,117 @@ func (bufferManager *BufferManager) sendRecords() (responseChan chan *http.Respo
 
 func (bufferManager *BufferManager) prepare(records []map[string]interface{}, responseChan chan *http.Response) {
 	config := &bufferManager.config
-	data, err := packagePayload(records)
+	payload, err := packagePayload(records, *config)
 	if err != nil {
 		panic(err)
 	}
-	if int64(data.Cap()) >= config.maxBufferSize {
+	if int64(len(payload)) >= config.maxBufferSize {
 		first := records[0 : len(records)/2]
 		second := records[len(records)/2 : len(records)]
 		bufferManager.prepare(first, responseChan)
 		bufferManager.prepare(second, responseChan)
-	} else {
-		go func() {
-			err := bufferManager.makeRequest(data, responseChan)
-			if err != nil {
-				log.Printf("[DEBUG] Error making HTTP request: %s", err)
-			}
-		}()
+		return
+	}
+
+	var ack func()
+	if bufferManager.spool != nil {
+		entry, err := bufferManager.spool.append(payload)
+		if err != nil {
+			log.Printf("[ERROR] failed writing to spool: %s", err)
+		} else {
+			ack = func() { bufferManager.spool.ack(entry) }
+		}
 	}
+	bufferManager.dispatch(flushJob{payload: payload, responseChan: responseChan, attempt: 1, ack: ack})
 }
 
-func (bufferManager *BufferManager) makeRequest(buffer *bytes.Buffer, responseChan chan *http.Response) error {
-	req, err := http.NewRequest("POST", bufferManager.config.endpoint, buffer)
+// makeRequest POSTs payload, the raw gzipped batch bytes. It takes []byte
+// rather than an already-built reader so that every attempt -- the first
+// and any retries -- reads from its own fresh bytes.NewReader: the HTTP
+// client fully drains whatever reader it's given, so reusing one across
+// attempts would send an empty body on retry.
+func (bufferManager *BufferManager) makeRequest(payload []byte, responseChan chan *http.Response, attempt int64, ack func()) error {
+	// context.WithTimeout on top of bufferManager.ctx gives us both the
+	// per-request deadline and shutdown cancellation (FLBPluginExit calls
+	// bufferManager.cancel once the grace period elapses) without a
+	// bespoke resettable timer; see TestMakeRequestHonorsPerRequestTimeout
+	// and TestMakeRequestStopsOnShutdownCancel for coverage of both paths.
+	reqCtx, cancel := context.WithTimeout(bufferManager.ctx, time.Duration(bufferManager.config.requestTimeoutMs)*time.Millisecond)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(reqCtx, "POST", bufferManager.config.endpoint, bytes.NewReader(payload))
 	if err != nil {
 		return err
 	}
-	if bufferManager.config.useApiKey {
+	if bufferManager.config.payloadFormat == payloadFormatOTLP {
+		// New Relic's OTLP/HTTP endpoint authenticates via a single
+		// "api-key" header, not the X-Insert-Key/X-License-Key pair the
+		// Logs API expects for the other payload formats.
+		if bufferManager.config.useApiKey {
+			req.Header.Add("api-key", bufferManager.config.apiKey)
+		} else {
+			req.Header.Add("api-key", bufferManager.config.licenseKey)
+		}
+	} else if bufferManager.config.useApiKey {
 		req.Header.Add("X-Insert-Key", bufferManager.config.apiKey)
 	} else {
 		req.Header.Add("X-License-Key", bufferManager.config.licenseKey)
 	}
 	req.Header.Add("Content-Encoding", "gzip")
-	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Content-Type", payloadContentType(bufferManager.config.payloadFormat))
 	resp, err := bufferManager.client.Do(req)
 	if (err != nil) {
 		log.Printf("[DEBUG] Error making HTTP request: %s", err)
+		bufferManager.enqueueRetry(payload, attempt, "", ack)
 		return err
-	} else if (resp.StatusCode != 202) {
-		log.Printf("[DEBUG] Error making HTTP request.  Got status code: %v", resp.StatusCode)
-		return nil
 	}
 	defer resp.Body.Close()
 	defer func() {
 		_, err = io.Copy(ioutil.Discard, resp.Body) // WE READ THE BODY
 	}()
-	if err != nil {
-		return err
-	}
 
-	responseChan <- resp
-	return nil
+	switch {
+	case resp.StatusCode == 202:
+		if responseChan != nil {
+			responseChan <- resp
+		}
+		if ack != nil {
+			ack()
+		}
+	case bufferManager.isPermanentFailure(resp.StatusCode):
+		log.Printf("[ERROR] permanent failure, dropping batch.  Got status code: %v", resp.StatusCode)
+		if ack != nil {
+			ack()
+		}
+	case bufferManager.isRetryableFailure(resp.StatusCode):
+		log.Printf("[DEBUG] transient failure, queuing retry.  Got status code: %v", resp.StatusCode)
+		bufferManager.enqueueRetry(payload, attempt, resp.Header.Get("Retry-After"), ack)
+	default:
+		log.Printf("[DEBUG] Error making HTTP request.  Got status code: %v", resp.StatusCode)
+		if ack != nil {
+			ack()
+		}
+	}
+	return err
 }
 
 //export FLBPluginInit
 func FLBPluginInit(ctx unsafe.Pointer) int {
 	var config PluginConfig
+
+	config.payloadFormat = output.FLBPluginConfigKey(ctx, "payloadFormat")
+	if len(config.payloadFormat) == 0 {
+		config.payloadFormat = payloadFormatArray
+	}
+
 	// Example to retrieve an optional configuration parameter
 	config.endpoint = output.FLBPluginConfigKey(ctx, "endpoint")
 	if len(config.endpoint) == 0 {
-		config.endpoint = "https://log-api.newrelic.com/log/v1"
+		if config.payloadFormat == payloadFormatOTLP {
+			config.endpoint = "https://otlp.nr-data.net/v1/logs"
+		} else {
+			config.endpoint = "https://log-api.newrelic.com/log/v1"
+		}
 	}
 	config.licenseKey = output.FLBPluginConfigKey(ctx, "licenseKey")
 	config.apiKey = output.FLBPluginConfigKey(ctx, "apiKey")
@@ -205,7 +334,104 @@ func FLBPluginInit(ctx unsafe.Pointer) int {
 		config.reportingSourceVersion =  reportingSourceVersion
 	}
 
-	bufferManager = newBufferManager(config)
+	possibleMaxRetries := output.FLBPluginConfigKey(ctx, "maxRetries")
+	if len(possibleMaxRetries) == 0 {
+		config.maxRetries = 5
+	} else {
+		config.maxRetries, _ = strconv.ParseInt(possibleMaxRetries, 10, 64)
+	}
+
+	possibleDisableRetryLimit := output.FLBPluginConfigKey(ctx, "disableRetryLimit")
+	if len(possibleDisableRetryLimit) == 0 {
+		config.disableRetryLimit = false
+	} else {
+		config.disableRetryLimit, _ = strconv.ParseBool(possibleDisableRetryLimit)
+	}
+
+	possibleRetryInitialBackoffMs := output.FLBPluginConfigKey(ctx, "retryInitialBackoffMs")
+	if len(possibleRetryInitialBackoffMs) == 0 {
+		config.retryInitialBackoffMs = 500
+	} else {
+		config.retryInitialBackoffMs, _ = strconv.ParseInt(possibleRetryInitialBackoffMs, 10, 64)
+	}
+
+	possibleRetryMaxBackoffMs := output.FLBPluginConfigKey(ctx, "retryMaxBackoffMs")
+	if len(possibleRetryMaxBackoffMs) == 0 {
+		config.retryMaxBackoffMs = 30000
+	} else {
+		config.retryMaxBackoffMs, _ = strconv.ParseInt(possibleRetryMaxBackoffMs, 10, 64)
+	}
+
+	possibleFlushWorkers := output.FLBPluginConfigKey(ctx, "flushWorkers")
+	if len(possibleFlushWorkers) == 0 {
+		config.flushWorkers = 4
+	} else {
+		config.flushWorkers, _ = strconv.ParseInt(possibleFlushWorkers, 10, 64)
+	}
+
+	possibleFlushQueueDepth := output.FLBPluginConfigKey(ctx, "flushQueueDepth")
+	if len(possibleFlushQueueDepth) == 0 {
+		config.flushQueueDepth = 256
+	} else {
+		config.flushQueueDepth, _ = strconv.ParseInt(possibleFlushQueueDepth, 10, 64)
+	}
+
+	config.spoolPath = output.FLBPluginConfigKey(ctx, "spoolPath")
+
+	possibleSpoolMaxSizeMB := output.FLBPluginConfigKey(ctx, "spoolMaxSizeMB")
+	if len(possibleSpoolMaxSizeMB) == 0 {
+		config.spoolMaxSizeMB = 100
+	} else {
+		config.spoolMaxSizeMB, _ = strconv.ParseInt(possibleSpoolMaxSizeMB, 10, 64)
+	}
+
+	possibleSpoolMaxBackups := output.FLBPluginConfigKey(ctx, "spoolMaxBackups")
+	if len(possibleSpoolMaxBackups) == 0 {
+		config.spoolMaxBackups = 5
+	} else {
+		config.spoolMaxBackups, _ = strconv.ParseInt(possibleSpoolMaxBackups, 10, 64)
+	}
+
+	possibleSpoolMaxAgeDays := output.FLBPluginConfigKey(ctx, "spoolMaxAgeDays")
+	if len(possibleSpoolMaxAgeDays) == 0 {
+		config.spoolMaxAgeDays = 7
+	} else {
+		config.spoolMaxAgeDays, _ = strconv.ParseInt(possibleSpoolMaxAgeDays, 10, 64)
+	}
+
+	possibleSpoolCompress := output.FLBPluginConfigKey(ctx, "spoolCompress")
+	if len(possibleSpoolCompress) == 0 {
+		config.spoolCompress = true
+	} else {
+		config.spoolCompress, _ = strconv.ParseBool(possibleSpoolCompress)
+	}
+
+	possibleRequestTimeoutMs := output.FLBPluginConfigKey(ctx, "requestTimeoutMs")
+	if len(possibleRequestTimeoutMs) == 0 {
+		config.requestTimeoutMs = 5000
+	} else {
+		config.requestTimeoutMs, _ = strconv.ParseInt(possibleRequestTimeoutMs, 10, 64)
+	}
+
+	possibleShutdownGracePeriodMs := output.FLBPluginConfigKey(ctx, "shutdownGracePeriodMs")
+	if len(possibleShutdownGracePeriodMs) == 0 {
+		config.shutdownGracePeriodMs = 5000
+	} else {
+		config.shutdownGracePeriodMs, _ = strconv.ParseInt(possibleShutdownGracePeriodMs, 10, 64)
+	}
+
+	possibleCommonAttributes := output.FLBPluginConfigKey(ctx, "commonAttributes")
+	if len(possibleCommonAttributes) > 0 {
+		config.commonAttributes = strings.Split(possibleCommonAttributes, ",")
+	}
+
+	config.severityKey = output.FLBPluginConfigKey(ctx, "severityKey")
+	if len(config.severityKey) == 0 {
+		config.severityKey = "level"
+	}
+
+	pluginCtx, cancel := context.WithCancel(context.Background())
+	bufferManager = newBufferManager(config, pluginCtx, cancel)
 	return output.FLB_OK
 }
 
@@ -232,6 +458,9 @@ func FLBPluginFlush(data unsafe.Pointer, length C.int, tag *C.char) int {
 	// output.FLB_OK    = data have been processed.
 	// output.FLB_ERROR = unrecoverable error, do not try this again.
 	// output.FLB_RETRY = retry to flush later.
+	if bufferManager.consumeRetrySignal() {
+		return output.FLB_RETRY
+	}
 	return output.FLB_OK
 }
 
@@ -295,30 +524,28 @@ func prepareRecord(inputRecord map[interface{}]interface{}, inputTimestamp inter
 	return
 }
 
-func packagePayload(records []map[string]interface{}) (*bytes.Buffer, error) {
-	var buffer bytes.Buffer
-	data, err := json.Marshal(records)
-	if err != nil {
-		panic(err)
-	}
-	g := gzip.NewWriter(&buffer)
-	if _, err = g.Write(data); err != nil {
-		panic(err)
-	}
-	if err := g.Flush(); err != nil {
-		panic(err)
-	}
-	if err = g.Close(); err != nil {
-		panic(err)
-	}
-	return &buffer, nil
-}
-
 //export FLBPluginExit
 func FLBPluginExit() int {
 	if !bufferManager.isEmpty() {
 		bufferManager.sendRecords()
 	}
+	bufferManager.closeRetryQueue()
+	bufferManager.closeFlushQueue()
+
+	drained := make(chan struct{})
+	go func() {
+		bufferManager.wg.Wait()
+		close(drained)
+	}()
+
+	gracePeriod := time.Duration(bufferManager.config.shutdownGracePeriodMs) * time.Millisecond
+	select {
+	case <-drained:
+	case <-time.After(gracePeriod):
+		log.Print("[ERROR] shutdown grace period exceeded, cancelling in-flight requests")
+		bufferManager.cancel()
+		<-drained
+	}
 	return output.FLB_OK
 }
 
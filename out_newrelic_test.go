@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMakeRequestHonorsPerRequestTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.WriteHeader(202)
+	}))
+	defer server.Close()
+
+	bm := &BufferManager{
+		config:      PluginConfig{endpoint: server.URL, requestTimeoutMs: 10, maxRetries: 0},
+		client:      server.Client(),
+		retryQueue:  make(chan retryPayload, 1),
+		retrySignal: new(int32),
+		ctx:         context.Background(),
+	}
+
+	start := time.Now()
+	err := bm.makeRequest([]byte("payload"), nil, 1, nil)
+	if err == nil {
+		t.Fatal("expected the per-request timeout to fail the request")
+	}
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Fatalf("expected makeRequest to return around the 10ms timeout, took %s", elapsed)
+	}
+}
+
+func TestMakeRequestStopsOnShutdownCancel(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.WriteHeader(202)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	bm := &BufferManager{
+		config:      PluginConfig{endpoint: server.URL, requestTimeoutMs: 5000, maxRetries: 0},
+		client:      server.Client(),
+		retryQueue:  make(chan retryPayload, 1),
+		retrySignal: new(int32),
+		ctx:         ctx,
+	}
+	cancel()
+
+	start := time.Now()
+	err := bm.makeRequest([]byte("payload"), nil, 1, nil)
+	if err == nil {
+		t.Fatal("expected a cancelled shutdown context to fail in-flight requests immediately")
+	}
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Fatalf("expected makeRequest to fail immediately once ctx is cancelled, took %s", elapsed)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+)
+
+const (
+	payloadFormatArray    = "array"
+	payloadFormatEnvelope = "envelope"
+	payloadFormatOTLP     = "otlp"
+)
+
+// packagePayload builds the gzipped HTTP body for a batch of records in the
+// configured payloadFormat: the New Relic Logs API's bare array (the
+// default), its common+logs envelope, or protobuf-encoded OTLP/HTTP logs.
+// It returns the raw gzipped bytes rather than a *bytes.Buffer, since the
+// same payload may be handed to the HTTP client across several retry
+// attempts and a buffer would be drained after the first.
+func packagePayload(records []map[string]interface{}, config PluginConfig) ([]byte, error) {
+	var raw []byte
+	var err error
+
+	switch config.payloadFormat {
+	case payloadFormatEnvelope:
+		raw, err = buildEnvelopePayload(records, config)
+	case payloadFormatOTLP:
+		raw, err = buildOTLPPayload(records, config)
+	default:
+		raw, err = json.Marshal(records)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	gzipped, err := gzipBytes(raw)
+	if err != nil {
+		return nil, err
+	}
+	return gzipped.Bytes(), nil
+}
+
+func payloadContentType(format string) string {
+	if format == payloadFormatOTLP {
+		return "application/x-protobuf"
+	}
+	return "application/json"
+}
+
+func gzipBytes(data []byte) (*bytes.Buffer, error) {
+	var buffer bytes.Buffer
+	g := gzip.NewWriter(&buffer)
+	if _, err := g.Write(data); err != nil {
+		return nil, err
+	}
+	if err := g.Flush(); err != nil {
+		return nil, err
+	}
+	if err := g.Close(); err != nil {
+		return nil, err
+	}
+	return &buffer, nil
+}
+
+// logEnvelope is the New Relic Logs API's richer batch shape, letting
+// attributes shared by every record in the batch (host, cluster,
+// nr.reportingSource, ...) be sent once instead of duplicated per record.
+// Common is a pointer because omitempty on a struct field doesn't suppress
+// a zero-value struct: only a nil pointer omits "common" from a batch that
+// has no shared attributes.
+type logEnvelope struct {
+	Common *logCommon               `json:"common,omitempty"`
+	Logs   []map[string]interface{} `json:"logs"`
+}
+
+type logCommon struct {
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+}
+
+// buildEnvelopePayload hoists config.commonAttributes keys into the common
+// block when their value is identical across every record in the batch,
+// leaving any key that varies on the individual log entries.
+func buildEnvelopePayload(records []map[string]interface{}, config PluginConfig) ([]byte, error) {
+	common := map[string]interface{}{}
+	for _, key := range config.commonAttributes {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		if value, ok := commonValue(records, key); ok {
+			common[key] = value
+		}
+	}
+
+	logs := make([]map[string]interface{}, 0, len(records))
+	for _, record := range records {
+		logRecord := make(map[string]interface{}, len(record))
+		for key, value := range record {
+			if _, hoisted := common[key]; hoisted {
+				continue
+			}
+			logRecord[key] = value
+		}
+		logs = append(logs, logRecord)
+	}
+
+	envelope := logEnvelope{Logs: logs}
+	if len(common) > 0 {
+		envelope.Common = &logCommon{Attributes: common}
+	}
+	return json.Marshal([]logEnvelope{envelope})
+}
+
+// commonValue returns the value for key and true only if every record in
+// the batch has that key set to an identical value.
+func commonValue(records []map[string]interface{}, key string) (interface{}, bool) {
+	if len(records) == 0 {
+		return nil, false
+	}
+	value, ok := records[0][key]
+	if !ok {
+		return nil, false
+	}
+	for _, record := range records[1:] {
+		other, ok := record[key]
+		if !ok || !reflect.DeepEqual(other, value) {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// buildOTLPPayload converts a batch of records into a protobuf-encoded
+// OTLP ExportLogsServiceRequest for POSTing to an OTLP/HTTP logs endpoint.
+func buildOTLPPayload(records []map[string]interface{}, config PluginConfig) ([]byte, error) {
+	scopeLogs := &logspb.ScopeLogs{}
+	for _, record := range records {
+		scopeLogs.LogRecords = append(scopeLogs.LogRecords, buildLogRecord(record, config))
+	}
+
+	request := &collogspb.ExportLogsServiceRequest{
+		ResourceLogs: []*logspb.ResourceLogs{
+			{
+				Resource:  &resourcepb.Resource{},
+				ScopeLogs: []*logspb.ScopeLogs{scopeLogs},
+			},
+		},
+	}
+	return proto.Marshal(request)
+}
+
+func buildLogRecord(record map[string]interface{}, config PluginConfig) *logspb.LogRecord {
+	logRecord := &logspb.LogRecord{}
+
+	if timestamp, ok := record["timestamp"].(int64); ok {
+		logRecord.TimeUnixNano = uint64(timestamp) * uint64(time.Millisecond)
+	}
+
+	if message, ok := record["message"]; ok {
+		logRecord.Body = stringValue(fmt.Sprintf("%v", message))
+	}
+
+	severityText, _ := record[config.severityKey].(string)
+	logRecord.SeverityText = severityText
+	logRecord.SeverityNumber = severityNumber(severityText)
+
+	for key, value := range record {
+		if key == "timestamp" || key == "message" || key == config.severityKey {
+			continue
+		}
+		logRecord.Attributes = append(logRecord.Attributes, &commonpb.KeyValue{
+			Key:   key,
+			Value: stringValue(fmt.Sprintf("%v", value)),
+		})
+	}
+
+	return logRecord
+}
+
+func stringValue(value string) *commonpb.AnyValue {
+	return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}
+}
+
+func severityNumber(severityText string) logspb.SeverityNumber {
+	switch strings.ToLower(severityText) {
+	case "trace":
+		return logspb.SeverityNumber_SEVERITY_NUMBER_TRACE
+	case "debug":
+		return logspb.SeverityNumber_SEVERITY_NUMBER_DEBUG
+	case "info":
+		return logspb.SeverityNumber_SEVERITY_NUMBER_INFO
+	case "warn", "warning":
+		return logspb.SeverityNumber_SEVERITY_NUMBER_WARN
+	case "error":
+		return logspb.SeverityNumber_SEVERITY_NUMBER_ERROR
+	case "fatal", "critical":
+		return logspb.SeverityNumber_SEVERITY_NUMBER_FATAL
+	default:
+		return logspb.SeverityNumber_SEVERITY_NUMBER_UNSPECIFIED
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestBuildEnvelopePayloadHoistsSharedAttributes(t *testing.T) {
+	records := []map[string]interface{}{
+		{"host": "web-1", "message": "a"},
+		{"host": "web-1", "message": "b"},
+	}
+	config := PluginConfig{commonAttributes: []string{"host"}}
+
+	raw, err := buildEnvelopePayload(records, config)
+	if err != nil {
+		t.Fatalf("buildEnvelopePayload: %s", err)
+	}
+
+	var envelopes []map[string]interface{}
+	if err := json.Unmarshal(raw, &envelopes); err != nil {
+		t.Fatalf("unmarshal: %s", err)
+	}
+
+	common, ok := envelopes[0]["common"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("expected a common block, got %v", envelopes[0])
+	}
+	attributes, ok := common["attributes"].(map[string]interface{})
+	if !ok || attributes["host"] != "web-1" {
+		t.Fatalf("expected host to be hoisted into common.attributes, got %v", common)
+	}
+
+	logs := envelopes[0]["logs"].([]interface{})
+	for _, log := range logs {
+		if _, hasHost := log.(map[string]interface{})["host"]; hasHost {
+			t.Fatalf("expected host to be removed from individual log entries, got %v", log)
+		}
+	}
+}
+
+func TestBuildEnvelopePayloadOmitsCommonWhenNothingIsShared(t *testing.T) {
+	records := []map[string]interface{}{
+		{"host": "web-1", "message": "a"},
+		{"host": "web-2", "message": "b"},
+	}
+	config := PluginConfig{commonAttributes: []string{"host"}}
+
+	raw, err := buildEnvelopePayload(records, config)
+	if err != nil {
+		t.Fatalf("buildEnvelopePayload: %s", err)
+	}
+
+	var envelopes []map[string]interface{}
+	if err := json.Unmarshal(raw, &envelopes); err != nil {
+		t.Fatalf("unmarshal: %s", err)
+	}
+
+	if _, hasCommon := envelopes[0]["common"]; hasCommon {
+		t.Fatalf("expected common to be omitted entirely when no attributes are shared, got %v", envelopes[0])
+	}
+}
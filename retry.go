@@ -0,0 +1,142 @@
+package main
+
+import (
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// defaultRetryQueueDepth bounds how many failed batches can be waiting for
+// another delivery attempt at once. Once full, makeRequest drops the batch
+// and signals output.FLB_RETRY so Fluent Bit itself applies back-pressure.
+const defaultRetryQueueDepth = 1024
+
+// retryPayload is a gzipped request body that failed transiently and is
+// queued for redelivery with exponential backoff. payload holds the raw
+// gzipped bytes rather than an already-read *bytes.Buffer, since the HTTP
+// client drains whatever reader it's given and the same batch may need to
+// be replayed across several attempts.
+type retryPayload struct {
+	payload    []byte
+	attempt    int64
+	retryAfter string
+	ack        func()
+}
+
+func (bufferManager *BufferManager) isPermanentFailure(statusCode int) bool {
+	return statusCode == http.StatusBadRequest ||
+		statusCode == http.StatusUnauthorized ||
+		statusCode == http.StatusForbidden
+}
+
+func (bufferManager *BufferManager) isRetryableFailure(statusCode int) bool {
+	return statusCode >= 500 ||
+		statusCode == http.StatusRequestTimeout ||
+		statusCode == http.StatusTooManyRequests
+}
+
+// backoffDuration computes an exponential backoff, capped at
+// config.retryMaxBackoffMs, plus a random jitter of up to
+// config.retryInitialBackoffMs added on top of the cap. It honors a
+// server-provided Retry-After header when one is present.
+func (bufferManager *BufferManager) backoffDuration(attempt int64, retryAfter string) time.Duration {
+	config := &bufferManager.config
+	if retryAfter != "" {
+		if seconds, err := strconv.Atoi(retryAfter); err == nil {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+
+	backoffMs := float64(config.retryInitialBackoffMs) * math.Pow(2, float64(attempt-1))
+	if backoffMs > float64(config.retryMaxBackoffMs) {
+		backoffMs = float64(config.retryMaxBackoffMs)
+	}
+	jitterMs := rand.Int63n(config.retryInitialBackoffMs + 1)
+	return time.Duration(backoffMs)*time.Millisecond + time.Duration(jitterMs)*time.Millisecond
+}
+
+// enqueueRetry schedules a failed batch for another attempt. It drops the
+// batch and signals FLB_RETRY back to Fluent Bit when the batch has
+// exhausted maxRetries, the retry queue is saturated, or closeRetryQueue
+// has already run. A batch dropped for exhausting maxRetries is acked
+// rather than left pending: otherwise its spool entry (if any) would never
+// be marked delivered and it would be re-enqueued and dropped again on
+// every restart, forever. A batch dropped because the retry queue is full
+// or closed is not acked, so its spool entry (if any) stays on disk and is
+// re-enqueued on the next start.
+//
+// The send to retryQueue happens under retryQueueMu, which closeRetryQueue
+// also holds before closing the channel, so enqueueRetry can never race a
+// shutdown into sending on (or panicking against) an already-closed
+// channel the way a bare select could.
+func (bufferManager *BufferManager) enqueueRetry(payload []byte, attempt int64, retryAfter string, ack func()) {
+	config := &bufferManager.config
+	if !config.disableRetryLimit && attempt > config.maxRetries {
+		log.Printf("[ERROR] dropping batch after %d attempts", attempt)
+		bufferManager.signalRetry()
+		if ack != nil {
+			ack()
+		}
+		return
+	}
+
+	bufferManager.retryQueueMu.Lock()
+	defer bufferManager.retryQueueMu.Unlock()
+
+	if bufferManager.retryQueueClosed {
+		log.Print("[ERROR] retry queue is shutting down, dropping batch")
+		bufferManager.signalRetry()
+		return
+	}
+
+	select {
+	case bufferManager.retryQueue <- retryPayload{payload: payload, attempt: attempt, retryAfter: retryAfter, ack: ack}:
+	default:
+		log.Print("[ERROR] retry queue is full, dropping batch")
+		bufferManager.signalRetry()
+	}
+}
+
+// closeRetryQueue stops enqueueRetry from accepting new batches and closes
+// retryQueue so retryWorker can drain it and exit. Must only be called
+// once, from FLBPluginExit, before closeFlushQueue: retryWorker is tracked
+// in wg like the flush workers, so FLBPluginExit's wg.Wait() doesn't
+// return -- and batches still sitting in the retry queue at shutdown
+// aren't silently dropped -- until it has drained and exited too.
+func (bufferManager *BufferManager) closeRetryQueue() {
+	bufferManager.retryQueueMu.Lock()
+	defer bufferManager.retryQueueMu.Unlock()
+	bufferManager.retryQueueClosed = true
+	close(bufferManager.retryQueue)
+}
+
+// retryWorker drains the retry queue one batch at a time, waiting out the
+// backoff for each before handing it back to the flush worker pool via
+// dispatch. It no longer bails out on ctx.Done(): FLBPluginExit closes
+// flushQueue before cancelling ctx, and a naive select between the backoff
+// wait and ctx.Done() can still pick an already-closed flushQueue's send
+// case and panic. dispatch is the one place that safely tells whether the
+// pool has been shut down, so retryWorker always routes through it instead
+// of sending directly.
+func (bufferManager *BufferManager) retryWorker() {
+	defer bufferManager.wg.Done()
+	for payload := range bufferManager.retryQueue {
+		select {
+		case <-time.After(bufferManager.backoffDuration(payload.attempt, payload.retryAfter)):
+		case <-bufferManager.ctx.Done():
+		}
+		bufferManager.dispatch(flushJob{payload: payload.payload, attempt: payload.attempt + 1, ack: payload.ack})
+	}
+}
+
+func (bufferManager *BufferManager) signalRetry() {
+	atomic.StoreInt32(bufferManager.retrySignal, 1)
+}
+
+func (bufferManager *BufferManager) consumeRetrySignal() bool {
+	return atomic.SwapInt32(bufferManager.retrySignal, 0) == 1
+}
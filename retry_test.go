@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestBufferManager(config PluginConfig) *BufferManager {
+	return &BufferManager{
+		config:      config,
+		retryQueue:  make(chan retryPayload, 1),
+		retrySignal: new(int32),
+	}
+}
+
+func TestBackoffDurationCapsAtMax(t *testing.T) {
+	bm := newTestBufferManager(PluginConfig{retryInitialBackoffMs: 100, retryMaxBackoffMs: 1000})
+
+	d := bm.backoffDuration(5, "")
+	if d < 1000*time.Millisecond || d > 1100*time.Millisecond {
+		t.Fatalf("expected backoff capped at 1000ms plus jitter, got %s", d)
+	}
+}
+
+func TestBackoffDurationExponentialBeforeCap(t *testing.T) {
+	bm := newTestBufferManager(PluginConfig{retryInitialBackoffMs: 100, retryMaxBackoffMs: 10000})
+
+	d := bm.backoffDuration(3, "")
+	if d < 400*time.Millisecond || d > 500*time.Millisecond {
+		t.Fatalf("expected ~400ms plus jitter for attempt 3, got %s", d)
+	}
+}
+
+func TestBackoffDurationHonorsRetryAfter(t *testing.T) {
+	bm := newTestBufferManager(PluginConfig{retryInitialBackoffMs: 100, retryMaxBackoffMs: 1000})
+
+	d := bm.backoffDuration(1, "5")
+	if d != 5*time.Second {
+		t.Fatalf("expected Retry-After to override backoff math, got %s", d)
+	}
+}
+
+func TestEnqueueRetryDropsAfterMaxRetries(t *testing.T) {
+	bm := newTestBufferManager(PluginConfig{maxRetries: 2})
+
+	bm.enqueueRetry([]byte("batch"), 3, "", nil)
+
+	if !bm.consumeRetrySignal() {
+		t.Fatal("expected retry signal to be set once a batch exceeds maxRetries")
+	}
+	select {
+	case <-bm.retryQueue:
+		t.Fatal("expected batch to be dropped, not queued")
+	default:
+	}
+}
+
+func TestEnqueueRetrySignalsFlbRetryWhenQueueIsFull(t *testing.T) {
+	bm := newTestBufferManager(PluginConfig{maxRetries: 5, disableRetryLimit: true})
+	bm.retryQueue <- retryPayload{payload: []byte("already queued"), attempt: 1}
+
+	bm.enqueueRetry([]byte("overflow"), 1, "", nil)
+
+	if !bm.consumeRetrySignal() {
+		t.Fatal("expected retry signal to be set when the retry queue is saturated")
+	}
+	if bm.consumeRetrySignal() {
+		t.Fatal("expected consumeRetrySignal to reset the flag after reading it")
+	}
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const spoolFilePrefix = "spool."
+const spoolFileSuffix = ".log"
+const spoolIndexSuffix = ".idx"
+const spoolGzSuffix = ".gz"
+
+// spoolEntry identifies where a record batch was appended: the sidecar
+// index file it was logged to and its byte offset within the matching data
+// file. idxPath is captured once, at append time, from the segment that
+// was actually active then -- it names that segment's generation directly
+// (see Spool.segmentIdxPath) so it keeps pointing at the right file even
+// after the segment is rotated out from under it and a new generation
+// takes over as active. It's enough to ack the entry later, whether that
+// data file is still the active segment or has since been rotated out.
+type spoolEntry struct {
+	idxPath string
+	offset  int64
+}
+
+// spoolPending pairs a spool entry recovered from disk with the payload
+// bytes it points to, so it can be re-enqueued and later acked.
+type spoolPending struct {
+	payload []byte
+	entry   *spoolEntry
+}
+
+// Spool persists gzipped batches to disk before they are handed to the
+// flush worker pool, giving the plugin at-least-once delivery across
+// process crashes and New Relic back-pressure. Rotation follows
+// lumberjack's rolling-file conventions: roll the active file on size,
+// keep a bounded number of backups, gzip old segments, and prune beyond a
+// max age.
+//
+// Every segment (the active file and each rotated backup) is named after
+// its own generation number and carries its own sidecar ".idx" file
+// recording, as an append-only log, which offsets were written
+// ("A offset length") and which have since been acknowledged ("K offset").
+// Naming a segment after its generation rather than reusing one constant
+// "active" path means a spoolEntry's idxPath, captured once at append
+// time, never stops identifying the exact segment it was written to: a
+// batch that was rotated into a backup before New Relic acknowledged it is
+// still recoverable, and ack never mistakes it for an unrelated entry that
+// happens to share its byte offset in whatever segment is active now.
+// Because acks are appended rather than rewriting the whole index, logging
+// a batch stays O(1) regardless of how many entries came before it.
+type Spool struct {
+	mu         sync.Mutex
+	config     PluginConfig
+	file       *os.File
+	idxFile    *os.File
+	size       int64
+	generation int64
+}
+
+func newSpool(config PluginConfig) (*Spool, error) {
+	if err := os.MkdirAll(config.spoolPath, 0755); err != nil {
+		return nil, err
+	}
+	spool := &Spool{config: config}
+	generation, err := spool.discoverGeneration()
+	if err != nil {
+		return nil, err
+	}
+	spool.generation = generation
+	if err := spool.openActive(); err != nil {
+		return nil, err
+	}
+	return spool, nil
+}
+
+// segmentPath returns the data file path for generation, which never
+// changes once assigned: rotation always moves on to a new generation
+// number rather than renaming an existing segment.
+func (spool *Spool) segmentPath(generation int64) string {
+	return filepath.Join(spool.config.spoolPath, fmt.Sprintf("%s%d%s", spoolFilePrefix, generation, spoolFileSuffix))
+}
+
+func (spool *Spool) segmentIdxPath(generation int64) string {
+	return spool.segmentPath(generation) + spoolIndexSuffix
+}
+
+func (spool *Spool) activePath() string {
+	return spool.segmentPath(spool.generation)
+}
+
+func (spool *Spool) idxPath() string {
+	return spool.segmentIdxPath(spool.generation)
+}
+
+// discoverGeneration picks the generation to resume as active on startup:
+// the highest-numbered segment already on disk, so a restart keeps
+// appending to the same file it left off at, or one past it if that
+// segment was already rotated and compressed away (spool.N.log.gz present
+// but not the plain spool.N.log) before the process exited. An empty spool
+// directory starts at generation 0.
+func (spool *Spool) discoverGeneration() (int64, error) {
+	entries, err := ioutil.ReadDir(spool.config.spoolPath)
+	if err != nil {
+		return 0, err
+	}
+
+	maxGeneration := int64(-1)
+	plainLogExists := false
+	for _, entry := range entries {
+		generation, ok := parseGeneration(entry.Name())
+		if !ok {
+			continue
+		}
+		if generation > maxGeneration {
+			maxGeneration = generation
+			plainLogExists = strings.HasSuffix(entry.Name(), spoolFileSuffix)
+		} else if generation == maxGeneration && strings.HasSuffix(entry.Name(), spoolFileSuffix) {
+			plainLogExists = true
+		}
+	}
+
+	if maxGeneration == -1 {
+		return 0, nil
+	}
+	if plainLogExists {
+		return maxGeneration, nil
+	}
+	return maxGeneration + 1, nil
+}
+
+// parseGeneration extracts the generation number from a spool file's base
+// name (e.g. "spool.3.log", "spool.3.log.idx", "spool.3.log.gz"), or
+// returns false for anything else in the spool directory.
+func parseGeneration(name string) (int64, bool) {
+	if !strings.HasPrefix(name, spoolFilePrefix) {
+		return 0, false
+	}
+	rest := strings.TrimPrefix(name, spoolFilePrefix)
+	dot := strings.Index(rest, ".")
+	if dot < 0 {
+		return 0, false
+	}
+	generation, err := parseOffset(rest[:dot])
+	if err != nil {
+		return 0, false
+	}
+	return generation, true
+}
+
+func (spool *Spool) openActive() error {
+	file, err := os.OpenFile(spool.activePath(), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	idxFile, err := os.OpenFile(spool.idxPath(), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		idxFile.Close()
+		return err
+	}
+	spool.file = file
+	spool.idxFile = idxFile
+	spool.size = info.Size()
+	return nil
+}
+
+// append writes a gzipped payload to the active spool file as an 8-byte
+// big-endian length prefix followed by the payload, logs it as unacked in
+// the active segment's sidecar index, and returns a handle that can later
+// be passed to ack.
+func (spool *Spool) append(payload []byte) (*spoolEntry, error) {
+	spool.mu.Lock()
+	defer spool.mu.Unlock()
+
+	if spool.size >= spool.config.spoolMaxSizeMB*1024*1024 {
+		if err := spool.rotate(); err != nil {
+			return nil, err
+		}
+	}
+
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint64(header, uint64(len(payload)))
+
+	offset := spool.size
+	if _, err := spool.file.Write(header); err != nil {
+		return nil, err
+	}
+	if _, err := spool.file.Write(payload); err != nil {
+		return nil, err
+	}
+	spool.size += int64(len(header) + len(payload))
+
+	if _, err := fmt.Fprintf(spool.idxFile, "A %d %d\n", offset, len(payload)); err != nil {
+		log.Printf("[ERROR] failed appending to spool index: %s", err)
+	}
+	return &spoolEntry{idxPath: spool.idxPath(), offset: offset}, nil
+}
+
+// ack appends an acknowledgement record for entry to whichever segment's
+// sidecar index it belongs to -- the active one, or a backup it was
+// rotated into before being acked.
+func (spool *Spool) ack(entry *spoolEntry) {
+	spool.mu.Lock()
+	defer spool.mu.Unlock()
+
+	line := fmt.Sprintf("K %d\n", entry.offset)
+	if entry.idxPath == spool.idxPath() {
+		if _, err := spool.idxFile.WriteString(line); err != nil {
+			log.Printf("[ERROR] failed appending to spool index: %s", err)
+		}
+		return
+	}
+
+	f, err := os.OpenFile(entry.idxPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		log.Printf("[ERROR] failed acking rotated spool entry: %s", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.WriteString(line); err != nil {
+		log.Printf("[ERROR] failed acking rotated spool entry: %s", err)
+	}
+}
+
+// rotate closes the active segment and its sidecar index (gzipping the
+// data file, but not the index, when spoolCompress is set), prunes old
+// backups, and opens a fresh segment under the next generation number.
+// The just-closed segment keeps its name -- it becomes a backup in place,
+// with no rename -- so any spoolEntry already handed out for it still
+// resolves to the right file. Caller must hold spool.mu.
+func (spool *Spool) rotate() error {
+	if err := spool.file.Close(); err != nil {
+		return err
+	}
+	if err := spool.idxFile.Close(); err != nil {
+		return err
+	}
+
+	if spool.config.spoolCompress {
+		if err := gzipFile(spool.activePath()); err != nil {
+			log.Printf("[ERROR] failed compressing spool backup: %s", err)
+		}
+	}
+	spool.generation++
+	spool.pruneBackups()
+
+	return spool.openActive()
+}
+
+// pruneBackups deletes rotated spool segments (and their sidecar indexes)
+// older than spoolMaxAgeDays, then deletes the oldest remaining backups
+// beyond spoolMaxBackups. A zero value for either config key disables
+// that check. The current active segment is never a candidate.
+func (spool *Spool) pruneBackups() {
+	matches, err := filepath.Glob(filepath.Join(spool.config.spoolPath, spoolFilePrefix+"*"))
+	if err != nil {
+		return
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		gi, _ := parseGeneration(filepath.Base(matches[i]))
+		gj, _ := parseGeneration(filepath.Base(matches[j]))
+		return gi < gj
+	})
+
+	activePath := spool.activePath()
+	cutoff := time.Now().Add(-time.Duration(spool.config.spoolMaxAgeDays) * 24 * time.Hour)
+	var kept []string
+	for _, path := range matches {
+		if strings.HasSuffix(path, spoolIndexSuffix) || path == activePath {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if spool.config.spoolMaxAgeDays > 0 && info.ModTime().Before(cutoff) {
+			removeBackup(path)
+			continue
+		}
+		kept = append(kept, path)
+	}
+
+	if spool.config.spoolMaxBackups > 0 && int64(len(kept)) > spool.config.spoolMaxBackups {
+		for _, path := range kept[:int64(len(kept))-spool.config.spoolMaxBackups] {
+			removeBackup(path)
+		}
+	}
+}
+
+// removeBackup deletes a backup data file and its sidecar index. path may
+// be either the plain or gzipped form of the data file; the sidecar is
+// always named after the plain form.
+func removeBackup(path string) {
+	os.Remove(path)
+	os.Remove(strings.TrimSuffix(path, spoolGzSuffix) + spoolIndexSuffix)
+}
+
+func gzipFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	out, err := os.Create(path + ".gz")
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	g := gzip.NewWriter(out)
+	if _, err := g.Write(data); err != nil {
+		return err
+	}
+	if err := g.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// loadUnacked scans every segment's sidecar index -- the active file and
+// any rotated (optionally gzipped) backups -- and returns the payloads
+// that were never acknowledged, so FLBPluginInit can re-enqueue them
+// before accepting new records. A batch that was rotated into a backup
+// before New Relic acknowledged it is recovered just like one still in the
+// active file.
+func (spool *Spool) loadUnacked() []spoolPending {
+	spool.mu.Lock()
+	defer spool.mu.Unlock()
+
+	idxPaths, err := filepath.Glob(filepath.Join(spool.config.spoolPath, spoolFilePrefix+"*"+spoolFileSuffix+spoolIndexSuffix))
+	if err != nil {
+		return nil
+	}
+	sort.Strings(idxPaths)
+
+	var pending []spoolPending
+	for _, idxPath := range idxPaths {
+		dataPath := strings.TrimSuffix(idxPath, spoolIndexSuffix)
+		pending = append(pending, spool.loadUnackedSegment(idxPath, dataPath)...)
+	}
+	return pending
+}
+
+// loadUnackedSegment replays one segment's sidecar index to find unacked
+// offsets, then reads their payload bytes out of dataPath, transparently
+// decompressing it first if it was gzipped on rotation.
+func (spool *Spool) loadUnackedSegment(idxPath, dataPath string) []spoolPending {
+	idx, err := os.Open(idxPath)
+	if err != nil {
+		return nil
+	}
+	defer idx.Close()
+
+	type logged struct {
+		length int64
+		acked  bool
+	}
+	offsets := map[int64]*logged{}
+
+	scanner := bufio.NewScanner(idx)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		offset, err := parseOffset(fields[1])
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "A":
+			if len(fields) < 3 {
+				continue
+			}
+			length, err := parseOffset(fields[2])
+			if err != nil {
+				continue
+			}
+			offsets[offset] = &logged{length: length}
+		case "K":
+			if entry, ok := offsets[offset]; ok {
+				entry.acked = true
+			}
+		}
+	}
+
+	var unackedOffsets []int64
+	for offset, entry := range offsets {
+		if !entry.acked {
+			unackedOffsets = append(unackedOffsets, offset)
+		}
+	}
+	if len(unackedOffsets) == 0 {
+		return nil
+	}
+	sort.Slice(unackedOffsets, func(i, j int) bool { return unackedOffsets[i] < unackedOffsets[j] })
+
+	data, path, err := readSegmentData(dataPath)
+	if err != nil {
+		log.Printf("[ERROR] failed reading spool segment %s: %s", path, err)
+		return nil
+	}
+
+	var pending []spoolPending
+	for _, offset := range unackedOffsets {
+		length := offsets[offset].length
+		if offset+8+length > int64(len(data)) {
+			log.Printf("[ERROR] spool entry at %s:%d is truncated, skipping", path, offset)
+			continue
+		}
+		payload := make([]byte, length)
+		copy(payload, data[offset+8:offset+8+length])
+		pending = append(pending, spoolPending{
+			payload: payload,
+			entry:   &spoolEntry{idxPath: idxPath, offset: offset},
+		})
+	}
+	return pending
+}
+
+// readSegmentData returns dataPath's raw contents, looking for a ".gz"
+// variant and transparently decompressing it if the plain file no longer
+// exists -- rotate may have compressed it after the sidecar index was
+// written.
+func readSegmentData(dataPath string) ([]byte, string, error) {
+	if data, err := ioutil.ReadFile(dataPath); err == nil {
+		return data, dataPath, nil
+	}
+
+	gzPath := dataPath + ".gz"
+	f, err := os.Open(gzPath)
+	if err != nil {
+		return nil, dataPath, err
+	}
+	defer f.Close()
+
+	reader, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, gzPath, err
+	}
+	defer reader.Close()
+
+	data, err := ioutil.ReadAll(reader)
+	return data, gzPath, err
+}
+
+func parseOffset(field string) (int64, error) {
+	var value int64
+	_, err := fmt.Sscanf(field, "%d", &value)
+	return value, err
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"log"
+	"net/http"
+)
+
+// flushJob is one gzipped batch waiting to be POSTed by a flush worker.
+// payload holds the raw gzipped bytes rather than an already-read
+// *bytes.Buffer, since the same batch may need to be replayed across
+// several retry attempts. ack, when set, is called once New Relic has
+// acknowledged the batch so the spool (if any) can mark it delivered.
+type flushJob struct {
+	payload      []byte
+	responseChan chan *http.Response
+	attempt      int64
+	ack          func()
+}
+
+// flushWorker consumes jobs from flushQueue and performs the HTTP POST,
+// bounding how many requests can be in flight at once instead of spawning a
+// goroutine per batch. It runs until flushQueue is closed and drained, then
+// signals wg so FLBPluginExit can wait for a clean shutdown.
+func (bufferManager *BufferManager) flushWorker() {
+	defer bufferManager.wg.Done()
+	for job := range bufferManager.flushQueue {
+		err := bufferManager.makeRequest(job.payload, job.responseChan, job.attempt, job.ack)
+		if err != nil {
+			log.Printf("[DEBUG] Error making HTTP request: %s", err)
+		}
+	}
+}
+
+// dispatch hands a job to the flush worker pool. prepare, requeueUnacked,
+// and retryWorker all feed the pool through here rather than sending on
+// flushQueue directly, so that a retry racing with FLBPluginExit can never
+// send on a channel that's already been closed: once closeFlushQueue has
+// run, dispatch falls back to running the request inline instead of
+// queuing it.
+func (bufferManager *BufferManager) dispatch(job flushJob) {
+	bufferManager.flushQueueMu.Lock()
+	defer bufferManager.flushQueueMu.Unlock()
+
+	if bufferManager.flushQueueClosed {
+		err := bufferManager.makeRequest(job.payload, job.responseChan, job.attempt, job.ack)
+		if err != nil {
+			log.Printf("[DEBUG] Error making HTTP request: %s", err)
+		}
+		return
+	}
+	bufferManager.flushQueue <- job
+}
+
+// closeFlushQueue stops the flush worker pool from accepting new jobs via
+// dispatch and closes flushQueue so the pool's goroutines can drain and
+// exit. Must only be called once, from FLBPluginExit.
+func (bufferManager *BufferManager) closeFlushQueue() {
+	bufferManager.flushQueueMu.Lock()
+	defer bufferManager.flushQueueMu.Unlock()
+	bufferManager.flushQueueClosed = true
+	close(bufferManager.flushQueue)
+}
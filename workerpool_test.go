@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDispatchFallsBackToInlineAfterQueueClosed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(202)
+	}))
+	defer server.Close()
+
+	bm := &BufferManager{
+		config:      PluginConfig{endpoint: server.URL, requestTimeoutMs: 1000},
+		client:      server.Client(),
+		flushQueue:  make(chan flushJob, 1),
+		retryQueue:  make(chan retryPayload, 1),
+		retrySignal: new(int32),
+		ctx:         context.Background(),
+	}
+	bm.closeFlushQueue()
+
+	acked := make(chan struct{})
+	bm.dispatch(flushJob{payload: []byte("batch"), attempt: 1, ack: func() { close(acked) }})
+
+	select {
+	case <-acked:
+	case <-time.After(time.Second):
+		t.Fatal("expected dispatch to run the job inline and ack it once the flush queue is closed")
+	}
+}
+
+func TestDispatchQueuesWhileOpen(t *testing.T) {
+	bm := &BufferManager{
+		flushQueue: make(chan flushJob, 1),
+	}
+
+	bm.dispatch(flushJob{payload: []byte("batch"), attempt: 1})
+
+	select {
+	case job := <-bm.flushQueue:
+		if string(job.payload) != "batch" {
+			t.Fatalf("unexpected payload: %s", job.payload)
+		}
+	default:
+		t.Fatal("expected dispatch to queue the job while flushQueue is open")
+	}
+}